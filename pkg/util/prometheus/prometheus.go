@@ -0,0 +1,413 @@
+// Package prometheus contains helpers for exposing import/upload progress to Prometheus.
+package prometheus
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/expfmt"
+	"k8s.io/klog/v2"
+
+	"kubevirt.io/containerized-data-importer/pkg/util"
+)
+
+// DefaultThroughputBuckets are histogram buckets (in bytes/sec) for the throughput
+// HistogramVec passed to SetThroughputMetrics. ProgressReader does not apply them
+// itself; the buckets are whatever the caller built that histogram with.
+var DefaultThroughputBuckets = []float64{1 << 20, 10 << 20, 50 << 20, 100 << 20, 500 << 20, 1 << 30}
+
+// ProgressReader is a counting reader that reports progress to Prometheus.
+type ProgressReader struct {
+	util.CountingReader
+	total    uint64
+	progress *prometheus.CounterVec
+	ownerUID string
+	final    bool
+
+	lastProgress float64
+
+	throughput      *prometheus.HistogramVec
+	eta             *prometheus.GaugeVec
+	lastSampleTime  time.Time
+	lastSampleBytes uint64
+
+	pusher  *push.Pusher
+	pushCtx context.Context
+
+	exemplarProvider func() prometheus.Labels
+
+	stages        []progressStage
+	stageIndex    int
+	stageBaseline uint64
+	stageProgress *prometheus.GaugeVec
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// maxDrainBytes bounds how many bytes Close will read from the underlying reader
+// while draining it, so a still-open but unbounded stream can't block shutdown.
+const maxDrainBytes = 32 << 20 // 32MiB
+
+// drainDeadline bounds how long Close will wait for the drain to finish. It is a
+// var rather than a const so tests can shrink it instead of blocking for the real
+// duration on every run.
+var drainDeadline = 5 * time.Second
+
+// progressStage is one weighted leg of a multi-stage transfer, e.g. download,
+// decompress, convert-to-qcow2 or sparse-write. total is the number of bytes
+// CountingReader.Current is expected to advance by while the stage is active.
+type progressStage struct {
+	name   string
+	weight float64
+	total  uint64
+}
+
+// maxExemplarRunes is the maximum combined length, in runes, of an exemplar's
+// label names and values, per the Prometheus exemplar exposition format.
+const maxExemplarRunes = 128
+
+// NewProgressReader creates a new instance of the progress-reader.
+func NewProgressReader(r io.ReadCloser, total uint64, progress *prometheus.CounterVec, ownerUID string) *ProgressReader {
+	return &ProgressReader{
+		CountingReader: util.CountingReader{Reader: r, Current: 0},
+		total:          total,
+		progress:       progress,
+		ownerUID:       ownerUID,
+		final:          true,
+	}
+}
+
+// NewProgressReaderFromEnv creates a ProgressReader the same way as
+// NewProgressReader, additionally enabling push-gateway mode when PUSHGATEWAY_URL
+// is set in the environment, using PUSHGATEWAY_JOB (default "cdi-import") as the
+// job name. Importer/uploader entrypoints should construct their ProgressReader
+// through this constructor so pods still report terminal progress in deployments
+// without an in-cluster scrape path.
+func NewProgressReaderFromEnv(r io.ReadCloser, total uint64, progress *prometheus.CounterVec, ownerUID string) *ProgressReader {
+	pr := NewProgressReader(r, total, progress, ownerUID)
+	if pushURL := os.Getenv("PUSHGATEWAY_URL"); pushURL != "" {
+		jobName := os.Getenv("PUSHGATEWAY_JOB")
+		if jobName == "" {
+			jobName = "cdi-import"
+		}
+		pr.SetPusher(pushURL, jobName)
+	}
+	return pr
+}
+
+// NewProgressReaderWithPusher creates a ProgressReader that, in addition to being
+// scraped, actively pushes the progress counter to a Prometheus Pushgateway on every
+// StartTimedUpdate tick. This covers importer/uploader pods, which run as
+// short-lived Jobs and can be torn down before a scrape ever observes their final
+// 100% sample.
+func NewProgressReaderWithPusher(r io.ReadCloser, total uint64, progress *prometheus.CounterVec, ownerUID, pushURL, jobName string) *ProgressReader {
+	pr := NewProgressReader(r, total, progress, ownerUID)
+	pr.SetPusher(pushURL, jobName)
+	return pr
+}
+
+// SetPusher configures pr to push its progress counter to the Pushgateway at
+// pushURL under jobName on every tick, grouped by owner_uid plus pod name and
+// namespace (read from the downward API env vars POD_NAME/POD_NAMESPACE when set)
+// so that distinct importer pods don't clobber each other's samples. The grouping
+// key is deliberately not "ownerUID": the pushgateway client rejects pushing a
+// metric whose own labels (progress is itself labeled by ownerUID) overlap a
+// grouping key. The format defaults to text exposition; use SetPushFormat to
+// switch to OpenMetrics.
+func (r *ProgressReader) SetPusher(pushURL, jobName string) {
+	pusher := push.New(pushURL, jobName).
+		Collector(r.progress).
+		Format(expfmt.FmtText).
+		Grouping("owner_uid", r.ownerUID)
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		pusher = pusher.Grouping("pod", podName)
+	}
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		pusher = pusher.Grouping("namespace", namespace)
+	}
+	r.pusher = pusher
+	r.pushCtx = context.Background()
+}
+
+// SetPushFormat overrides the exposition format used when pushing to the
+// Pushgateway. Has no effect until a pusher has been configured via SetPusher or
+// NewProgressReaderWithPusher.
+func (r *ProgressReader) SetPushFormat(format expfmt.Format) {
+	if r.pusher != nil {
+		r.pusher = r.pusher.Format(format)
+	}
+}
+
+// SetPushContext sets the context used to cancel or time out Pushgateway pushes.
+// Defaults to context.Background() once a pusher is configured.
+func (r *ProgressReader) SetPushContext(ctx context.Context) {
+	r.pushCtx = ctx
+}
+
+func (r *ProgressReader) pushProgress() {
+	if r.pusher == nil {
+		return
+	}
+	if err := r.pusher.PushContext(r.pushCtx); err != nil {
+		klog.Errorf("failed to push progress to pushgateway: %v", err)
+	}
+}
+
+// SetThroughputMetrics enables per-tick throughput and ETA reporting on top of the
+// existing percent-complete counter. On every StartTimedUpdate tick, the reader
+// samples how many bytes were read since the previous tick, observes the resulting
+// bytes/sec rate into throughput, and sets eta to the estimated number of seconds
+// remaining at that rate. Pass nil for eta to only record throughput.
+func (r *ProgressReader) SetThroughputMetrics(throughput *prometheus.HistogramVec, eta *prometheus.GaugeVec) {
+	r.throughput = throughput
+	r.eta = eta
+	r.resetSampleBaseline()
+}
+
+// SetExemplarProvider attaches an exemplar source to the progress counter. On each
+// update, provider is invoked and, if it returns a non-empty label set within the
+// exemplar size limit, the sample is recorded with AddWithExemplar so a Grafana
+// progress panel can link straight through to the originating trace, pod or PVC.
+// Oversized label sets are dropped silently rather than causing a panic.
+func (r *ProgressReader) SetExemplarProvider(provider func() prometheus.Labels) {
+	r.exemplarProvider = provider
+}
+
+// validExemplar reports whether labels fits within the 128-rune exemplar limit
+// (combined length of all label names and values).
+func validExemplar(labels prometheus.Labels) bool {
+	total := 0
+	for k, v := range labels {
+		total += len([]rune(k)) + len([]rune(v))
+		if total > maxExemplarRunes {
+			return false
+		}
+	}
+	return true
+}
+
+// addProgress records delta against the progress counter, attaching an exemplar
+// when a provider is configured and its labels fit the exemplar size limit.
+func (r *ProgressReader) addProgress(delta float64) {
+	counter := r.progress.WithLabelValues(r.ownerUID)
+	if r.exemplarProvider != nil {
+		if adder, ok := counter.(prometheus.ExemplarAdder); ok {
+			if labels := r.exemplarProvider(); len(labels) > 0 && validExemplar(labels) {
+				adder.AddWithExemplar(delta, labels)
+				return
+			}
+		}
+	}
+	counter.Add(delta)
+}
+
+// AddStage declares a weighted stage of the overall transfer. weight is that
+// stage's share of the overall progress (weights need not sum to 1; they are
+// normalized), and total is the number of bytes CountingReader.Current is expected
+// to advance by while this stage is active. Declaring at least one stage switches
+// ProgressReader into multi-stage accounting, under which SetNextReader advances
+// to the next declared stage instead of just swapping the reader, and the exposed
+// percentage is sum(stageWeight_i * stageFraction_i) rather than Current/total.
+// With no stages declared, behavior is identical to the single-stage accounting.
+func (r *ProgressReader) AddStage(name string, weight float64, total uint64) {
+	r.stages = append(r.stages, progressStage{name: name, weight: weight, total: total})
+}
+
+// SetStageProgressMetric configures the gauge, labeled by ownerUID and stage (e.g.
+// cdi_import_stage_progress{ownerUID,stage}), used to report each declared stage's
+// own completion as a percentage. Each update sets only the active stage's value;
+// every stage is set to 100 once the final reader is done.
+func (r *ProgressReader) SetStageProgressMetric(stageProgress *prometheus.GaugeVec) {
+	r.stageProgress = stageProgress
+}
+
+// computeProgress returns the current overall progress percentage, either from the
+// plain Current/total ratio or, once stages have been declared, as the weighted sum
+// of each stage's completion fraction.
+func (r *ProgressReader) computeProgress() float64 {
+	if len(r.stages) == 0 {
+		return float64(r.Current) / float64(r.total) * 100.0
+	}
+
+	var totalWeight float64
+	for _, s := range r.stages {
+		totalWeight += s.weight
+	}
+	if totalWeight == 0 {
+		return 0
+	}
+
+	var progress float64
+	for i, s := range r.stages {
+		var fraction float64
+		switch {
+		case i < r.stageIndex:
+			fraction = 1
+		case i == r.stageIndex:
+			if s.total > 0 {
+				fraction = float64(r.Current-r.stageBaseline) / float64(s.total)
+				if fraction > 1 {
+					fraction = 1
+				}
+			}
+			if r.stageProgress != nil {
+				r.stageProgress.WithLabelValues(r.ownerUID, s.name).Set(fraction * 100.0)
+			}
+		}
+		progress += s.weight / totalWeight * fraction * 100.0
+	}
+	return progress
+}
+
+// StartTimedUpdate starts the update timer to update progress every second.
+func (r *ProgressReader) StartTimedUpdate() {
+	r.stopCh = make(chan struct{})
+	r.stopOnce = sync.Once{}
+	// Update progress every second
+	go func() {
+		for r.updateProgress() {
+			select {
+			case <-r.stopCh:
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// Close stops the update ticker started by StartTimedUpdate, drains whatever bytes
+// are still buffered in the underlying reader into the byte counter so Current
+// reflects what actually crossed the wire even if the caller aborts early (context
+// cancel, error), and closes the underlying reader. The drain is bounded by
+// maxDrainBytes and drainDeadline so a still-open, unbounded stream can't block
+// shutdown forever. Close is safe to call more than once (e.g. an explicit close
+// followed by a deferred one on an early-return path); only the first call drains
+// and closes the underlying reader, and every call returns that first call's error.
+func (r *ProgressReader) Close() error {
+	if r.stopCh != nil {
+		r.stopOnce.Do(func() { close(r.stopCh) })
+	}
+
+	r.closeOnce.Do(func() {
+		r.drain()
+		if r.CountingReader.Reader == nil {
+			return
+		}
+		r.closeErr = r.CountingReader.Reader.Close()
+	})
+	return r.closeErr
+}
+
+// drain reads up to maxDrainBytes from r into the byte counter, giving up after
+// drainDeadline, so the bytes a caller already received over the wire but hadn't
+// finished reading are still reflected in the progress counter.
+func (r *ProgressReader) drain() {
+	if r.CountingReader.Reader == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(io.Discard, io.LimitReader(r, maxDrainBytes))
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainDeadline):
+	}
+}
+
+// SetNextReader sets the next reader for the progress tracker, preserving the byte
+// count accumulated so far. final indicates whether this is the last reader in the
+// chain, i.e. whether updateProgress should stop once it finishes. When stages have
+// been declared via AddStage, this also advances to the next stage so its
+// completion fraction is tracked against a fresh baseline instead of the previous
+// stage's byte count.
+func (r *ProgressReader) SetNextReader(reader io.ReadCloser, final bool) {
+	r.CountingReader.Reader = reader
+	r.final = final
+	r.resetSampleBaseline()
+	if len(r.stages) > 0 && r.stageIndex < len(r.stages)-1 {
+		r.stageIndex++
+		r.stageBaseline = r.Current
+	}
+}
+
+// resetSampleBaseline resets the throughput sampler's baseline so that switching to
+// a new underlying reader does not produce a spurious rate spike on the next tick.
+func (r *ProgressReader) resetSampleBaseline() {
+	r.lastSampleTime = time.Now()
+	r.lastSampleBytes = r.Current
+}
+
+func (r *ProgressReader) sampleThroughput() {
+	if r.throughput == nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(r.lastSampleTime).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	delta := r.Current - r.lastSampleBytes
+	rate := float64(delta) / elapsed
+	r.throughput.WithLabelValues(r.ownerUID).Observe(rate)
+	if total := r.etaTotal(); r.eta != nil && rate > 0 && total > r.Current {
+		r.eta.WithLabelValues(r.ownerUID).Set(float64(total-r.Current) / rate)
+	}
+	r.lastSampleTime = now
+	r.lastSampleBytes = r.Current
+}
+
+// etaTotal returns the byte count ETA is measured against: the sum of the declared
+// stage totals once AddStage has been used, or the single-stage total otherwise.
+// Without this, combining SetThroughputMetrics with AddStage would compute ETA
+// against the original single-stage total, which no longer matches what Current
+// counts towards once stages are in play.
+func (r *ProgressReader) etaTotal() uint64 {
+	if len(r.stages) == 0 {
+		return r.total
+	}
+	var total uint64
+	for _, s := range r.stages {
+		total += s.total
+	}
+	return total
+}
+
+func (r *ProgressReader) updateProgress() bool {
+	if len(r.stages) == 0 && r.total == 0 {
+		return false
+	}
+
+	r.sampleThroughput()
+
+	currentProgress := r.computeProgress()
+	done := r.CountingReader.Done && r.final
+	if done {
+		// total (or each stage's total) is an estimated size, not an exact byte
+		// count, so Current rarely lands on it exactly. Clamp to 100% once the
+		// final reader has been fully consumed so dashboards reach completion
+		// instead of permanently stalling just under it.
+		currentProgress = 100.0
+		if r.stageProgress != nil {
+			for _, s := range r.stages {
+				r.stageProgress.WithLabelValues(r.ownerUID, s.name).Set(100.0)
+			}
+		}
+	}
+	r.addProgress(currentProgress - r.lastProgress)
+	r.lastProgress = currentProgress
+
+	r.pushProgress()
+
+	return !done
+}
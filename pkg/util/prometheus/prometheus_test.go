@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -113,6 +117,25 @@ var _ = Describe("Update Progress", func() {
 		Expect(*metric.Counter.Value).To(Equal(float64(100)))
 	})
 
+	It("clamps to 100% on completion even when Current never lands exactly on total", func() {
+		metric := &dto.Metric{}
+		By("Calling updateProgress with value")
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{
+				Current: uint64(987),
+				Done:    true,
+			},
+			total:    uint64(1000),
+			progress: progress,
+			ownerUID: ownerUID,
+			final:    true,
+		}
+		result := promReader.updateProgress()
+		Expect(false).To(Equal(result))
+		progress.WithLabelValues(ownerUID).Write(metric)
+		Expect(*metric.Counter.Value).To(Equal(float64(100)))
+	})
+
 	DescribeTable("update progress on non-final readers", func(readerDone, isFinal, expectedResult bool) {
 		promReader := &ProgressReader{
 			CountingReader: util.CountingReader{
@@ -181,3 +204,364 @@ var _ = Describe("Update Progress", func() {
 		Expect(false).To(Equal(result))
 	})
 })
+
+var _ = Describe("Throughput and ETA metrics", func() {
+	It("observes the instantaneous rate and sets ETA from the delta since the previous tick", func() {
+		throughput := prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "test_throughput",
+				Help:    "The test throughput in bytes/sec",
+				Buckets: DefaultThroughputBuckets,
+			},
+			[]string{"ownerUID"},
+		)
+		eta := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "test_eta",
+				Help: "The test ETA in seconds",
+			},
+			[]string{"ownerUID"},
+		)
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_throughput", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Current: uint64(50)},
+			total:          uint64(100),
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+			final:          true,
+		}
+		promReader.SetThroughputMetrics(throughput, eta)
+		// Pretend a tick elapsed a second ago with no bytes read yet, so the sample below
+		// reflects a clean 50 bytes/sec rate.
+		promReader.lastSampleTime = time.Now().Add(-time.Second)
+		promReader.lastSampleBytes = uint64(0)
+
+		promReader.sampleThroughput()
+
+		throughputMetric := &dto.Metric{}
+		throughputObserver, ok := throughput.WithLabelValues(ownerUID).(prometheus.Histogram)
+		Expect(ok).To(BeTrue())
+		Expect(throughputObserver.Write(throughputMetric)).To(Succeed())
+		Expect(throughputMetric.GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+		Expect(throughputMetric.GetHistogram().GetSampleSum()).To(BeNumerically("~", 50, 5))
+
+		etaMetric := &dto.Metric{}
+		Expect(eta.WithLabelValues(ownerUID).Write(etaMetric)).To(Succeed())
+		// (total 100 - Current 50) / 50 bytes/sec == 1 second remaining.
+		Expect(etaMetric.GetGauge().GetValue()).To(BeNumerically("~", 1, 0.1))
+	})
+
+	It("resets the sampler baseline on SetNextReader so switching readers doesn't spike the rate", func() {
+		throughput := prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: "test_throughput_reset", Help: "The test throughput in bytes/sec", Buckets: DefaultThroughputBuckets},
+			[]string{"ownerUID"},
+		)
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_throughput_reset", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Reader: io.NopCloser(strings.NewReader("first"))},
+			total:          uint64(100),
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+		}
+		promReader.SetThroughputMetrics(throughput, nil)
+
+		data := make([]byte, 10)
+		_, _ = promReader.Read(data)
+		Expect(promReader.CountingReader.Current).To(Equal(uint64(5)))
+
+		promReader.SetNextReader(io.NopCloser(strings.NewReader("second")), false)
+		Expect(promReader.lastSampleBytes).To(Equal(uint64(5)))
+		Expect(promReader.lastSampleTime).To(BeTemporally("~", time.Now(), time.Second))
+	})
+})
+
+var _ = Describe("Exemplar support", func() {
+	It("attaches an exemplar to the progress sample when the provider returns labels within the size limit", func() {
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_exemplar", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Current: uint64(10)},
+			total:          uint64(100),
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+			final:          true,
+		}
+		promReader.SetExemplarProvider(func() prometheus.Labels {
+			return prometheus.Labels{"traceID": "abc123"}
+		})
+
+		result := promReader.updateProgress()
+		Expect(result).To(Equal(true))
+
+		metric := &dto.Metric{}
+		Expect(testProgress.WithLabelValues(ownerUID).Write(metric)).To(Succeed())
+		Expect(metric.GetCounter().GetValue()).To(Equal(float64(10)))
+		Expect(metric.GetCounter().GetExemplar()).ToNot(BeNil())
+	})
+
+	It("falls back to a plain Add when no exemplar provider is configured", func() {
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_no_exemplar", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Current: uint64(10)},
+			total:          uint64(100),
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+			final:          true,
+		}
+
+		Expect(promReader.updateProgress()).To(Equal(true))
+
+		metric := &dto.Metric{}
+		Expect(testProgress.WithLabelValues(ownerUID).Write(metric)).To(Succeed())
+		Expect(metric.GetCounter().GetExemplar()).To(BeNil())
+	})
+
+	It("treats a 128-rune combined label set as valid (inclusive boundary)", func() {
+		labels := prometheus.Labels{"k": strings.Repeat("a", 127)}
+		Expect(validExemplar(labels)).To(BeTrue())
+	})
+
+	It("rejects a 129-rune combined label set", func() {
+		labels := prometheus.Labels{"k": strings.Repeat("a", 128)}
+		Expect(validExemplar(labels)).To(BeFalse())
+	})
+})
+
+var _ = Describe("Multi-stage weighted progress", func() {
+	It("computes overall progress as the weighted sum of each stage's completion fraction", func() {
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_stages", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		stageProgress := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "test_stage_progress", Help: "The test per-stage progress in percentage"},
+			[]string{"ownerUID", "stage"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Reader: io.NopCloser(strings.NewReader("1234567890"))},
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+		}
+		promReader.AddStage("download", 1, 10)
+		promReader.AddStage("decompress", 1, 10)
+		promReader.AddStage("convert", 2, 20)
+		promReader.SetStageProgressMetric(stageProgress)
+
+		data := make([]byte, 10)
+		_, _ = promReader.Read(data)
+		// Stage "download" (weight 1/4) is fully done: 1/4 * 100 == 25.
+		Expect(promReader.computeProgress()).To(BeNumerically("~", 25, 0.001))
+
+		promReader.SetNextReader(io.NopCloser(strings.NewReader("0123456789")), false)
+		_, _ = promReader.Read(data)
+		// "download" and "decompress" (weight 1/4 each) are both done: 25 + 25 == 50.
+		Expect(promReader.computeProgress()).To(BeNumerically("~", 50, 0.001))
+
+		promReader.SetNextReader(io.NopCloser(strings.NewReader(strings.Repeat("a", 20))), true)
+		half := make([]byte, 10)
+		_, _ = promReader.Read(half)
+		// "convert" (weight 2/4) is half done: 50 + (2/4 * 50) == 75.
+		Expect(promReader.computeProgress()).To(BeNumerically("~", 75, 0.001))
+
+		metric := &dto.Metric{}
+		Expect(stageProgress.WithLabelValues(ownerUID, "convert").Write(metric)).To(Succeed())
+		Expect(metric.GetGauge().GetValue()).To(BeNumerically("~", 50, 0.001))
+	})
+
+	It("falls back to the plain Current/total ratio when no stages are declared", func() {
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_no_stages", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		promReader := &ProgressReader{
+			CountingReader: util.CountingReader{Current: uint64(30)},
+			total:          uint64(120),
+			progress:       testProgress,
+			ownerUID:       ownerUID,
+		}
+		Expect(promReader.computeProgress()).To(BeNumerically("~", 25, 0.001))
+	})
+
+	It("derives the ETA denominator from the declared stage totals instead of the single-stage total", func() {
+		throughput := prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: "test_throughput_stages", Help: "The test throughput in bytes/sec", Buckets: DefaultThroughputBuckets},
+			[]string{"ownerUID"},
+		)
+		eta := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{Name: "test_eta_stages", Help: "The test ETA in seconds"},
+			[]string{"ownerUID"},
+		)
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_eta_stages", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		// total is deliberately unrelated to the stage totals below, to prove ETA ignores it
+		// once stages are declared.
+		promReader := NewProgressReader(ioutil.NopCloser(bytes.NewReader(nil)), uint64(5), testProgress, ownerUID)
+		promReader.AddStage("download", 1, 100)
+		promReader.AddStage("convert", 1, 100)
+		promReader.SetThroughputMetrics(throughput, eta)
+		promReader.CountingReader.Current = uint64(50)
+		promReader.lastSampleTime = time.Now().Add(-time.Second)
+		promReader.lastSampleBytes = uint64(0)
+
+		promReader.sampleThroughput()
+
+		etaMetric := &dto.Metric{}
+		Expect(eta.WithLabelValues(ownerUID).Write(etaMetric)).To(Succeed())
+		// rate == 50 bytes/sec, remaining == stage totals (200) - Current (50) == 150, so ETA == 3s.
+		Expect(etaMetric.GetGauge().GetValue()).To(BeNumerically("~", 3, 0.1))
+	})
+})
+
+var _ = Describe("Push gateway mode", func() {
+	It("pushes the progress counter to the configured Pushgateway on every tick", func() {
+		received := make(chan *http.Request, 2)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received <- req
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_push", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		r := ioutil.NopCloser(bytes.NewReader([]byte("hello world")))
+		progressReader := NewProgressReaderWithPusher(r, uint64(11), testProgress, ownerUID, server.URL, "cdi-test-job")
+
+		data := make([]byte, 11)
+		_, err := progressReader.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = progressReader.Read(data)
+		Expect(err).To(Equal(io.EOF))
+		result := progressReader.updateProgress()
+		Expect(result).To(Equal(false))
+
+		Eventually(received).Should(Receive())
+	})
+
+	It("enables push mode via PUSHGATEWAY_URL/PUSHGATEWAY_JOB when constructed from the environment", func() {
+		Expect(os.Setenv("PUSHGATEWAY_URL", "http://127.0.0.1:0")).To(Succeed())
+		Expect(os.Setenv("PUSHGATEWAY_JOB", "cdi-test-job")).To(Succeed())
+		defer func() {
+			_ = os.Unsetenv("PUSHGATEWAY_URL")
+			_ = os.Unsetenv("PUSHGATEWAY_JOB")
+		}()
+
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_push_env", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		r := ioutil.NopCloser(bytes.NewReader([]byte("hi")))
+		progressReader := NewProgressReaderFromEnv(r, uint64(2), testProgress, ownerUID)
+
+		Expect(progressReader.pusher).ToNot(BeNil())
+	})
+
+	It("leaves push mode disabled when PUSHGATEWAY_URL is not set", func() {
+		Expect(os.Unsetenv("PUSHGATEWAY_URL")).To(Succeed())
+
+		testProgress := prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "test_progress_push_env_disabled", Help: "The test progress in percentage"},
+			[]string{"ownerUID"},
+		)
+		r := ioutil.NopCloser(bytes.NewReader([]byte("hi")))
+		progressReader := NewProgressReaderFromEnv(r, uint64(2), testProgress, ownerUID)
+
+		Expect(progressReader.pusher).To(BeNil())
+	})
+})
+
+var _ = Describe("Close", func() {
+	newCloseTestCounter := func() *prometheus.CounterVec {
+		return prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "test_progress_close",
+				Help: "The test progress in percentage",
+			},
+			[]string{"ownerUID"},
+		)
+	}
+
+	It("drains bytes left buffered by an early cancel and closes the underlying reader", func() {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			_, _ = pipeWriter.Write([]byte("hello world"))
+			_ = pipeWriter.Close()
+		}()
+
+		// Simulate a caller that cancelled mid-read: only the first 5 bytes were
+		// consumed before Close is called, so 6 bytes remain buffered.
+		progressReader := NewProgressReader(ioutil.NopCloser(pipeReader), uint64(11), newCloseTestCounter(), ownerUID)
+		data := make([]byte, 5)
+		read, err := progressReader.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(5))
+
+		Expect(progressReader.Close()).To(Succeed())
+		Expect(progressReader.CountingReader.Current).To(Equal(uint64(11)))
+
+		_, err = progressReader.Read(data)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("stops draining once maxDrainBytes have been read, even if the source never reaches EOF", func() {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			buf := make([]byte, 64<<10)
+			for {
+				if _, err := pipeWriter.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		progressReader := NewProgressReader(ioutil.NopCloser(pipeReader), uint64(1<<40), newCloseTestCounter(), ownerUID)
+		Expect(progressReader.Close()).To(Succeed())
+		Expect(progressReader.CountingReader.Current).To(BeNumerically("<=", maxDrainBytes))
+	})
+
+	It("gives up after the drain deadline when the source blocks indefinitely", func() {
+		originalDeadline := drainDeadline
+		drainDeadline = 50 * time.Millisecond
+		defer func() { drainDeadline = originalDeadline }()
+
+		pipeReader, _ := io.Pipe()
+		progressReader := NewProgressReader(ioutil.NopCloser(pipeReader), uint64(100), newCloseTestCounter(), ownerUID)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			Expect(progressReader.Close()).To(Succeed())
+		}()
+		Eventually(closed, 2*drainDeadline).Should(BeClosed())
+	})
+
+	It("is safe to call Close twice", func() {
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			_, _ = pipeWriter.Write([]byte("hello world"))
+			_ = pipeWriter.Close()
+		}()
+
+		progressReader := NewProgressReader(ioutil.NopCloser(pipeReader), uint64(11), newCloseTestCounter(), ownerUID)
+		data := make([]byte, 5)
+		_, err := progressReader.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(progressReader.Close()).To(Succeed())
+		Expect(progressReader.Close()).To(Succeed())
+	})
+})